@@ -0,0 +1,221 @@
+package mmdbwriter
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// readCtrlByte decodes the control byte (and, for extended types, the
+// second byte) at the start of b, returning the value's type, its
+// declared size, and the number of header bytes consumed. It mirrors
+// writeCtrlByte and does not understand the pointer type's distinct
+// control byte layout; callers must check for a pointer before calling
+// this.
+func readCtrlByte(b []byte) (typeNum, int, int, error) {
+	if len(b) == 0 {
+		return 0, 0, 0, errors.New("unexpected end of data while reading control byte")
+	}
+
+	tn := typeNum(b[0] >> 5)
+	consumed := 1
+	if tn == typeNumExtended {
+		if len(b) < 2 {
+			return 0, 0, 0, errors.New("unexpected end of data while reading extended type")
+		}
+		tn = typeNum(b[1]) + 7
+		consumed++
+	}
+
+	switch sizeBits := b[0] & 0x1f; {
+	case sizeBits < 29:
+		return tn, int(sizeBits), consumed, nil
+	case sizeBits == 29:
+		if len(b) < consumed+1 {
+			return 0, 0, 0, errors.New("unexpected end of data while reading size")
+		}
+		return tn, firstSize + int(b[consumed]), consumed + 1, nil
+	case sizeBits == 30:
+		if len(b) < consumed+2 {
+			return 0, 0, 0, errors.New("unexpected end of data while reading size")
+		}
+		size := secondSize + int(binary.BigEndian.Uint16(b[consumed:consumed+2]))
+		return tn, size, consumed + 2, nil
+	default:
+		if len(b) < consumed+3 {
+			return 0, 0, 0, errors.New("unexpected end of data while reading size")
+		}
+		size := thirdSize +
+			int(b[consumed])<<16 + int(b[consumed+1])<<8 + int(b[consumed+2])
+		return tn, size, consumed + 3, nil
+	}
+}
+
+// readDataType decodes a single DataType value from the front of b,
+// returning the value and the number of bytes consumed. Pointers are
+// rejected: this is used to replay WAL records, which are always
+// encoded with pointers disabled (see newDataWriter in encodeInsertPayload).
+// The metadata section may contain pointers and is decoded with readValue
+// instead (see Load).
+func readDataType(b []byte) (DataType, int, error) {
+	return readValue(b, nil)
+}
+
+// resolver fetches the bytes starting at a data section offset that a
+// pointer refers to. It is nil when decoding a blob, such as a WAL
+// record, that is known never to contain a pointer.
+type resolver func(offset int) ([]byte, error)
+
+// maxPointerChainDepth bounds how many pointers readValue will follow
+// along any one path from the value it starts decoding, counting the
+// pointers followed to reach an enclosing Map or Slice. It is far more
+// than any legitimate encoder (including writeWithDedup, which only ever
+// points at an inline value, never at another pointer, so a path holds
+// at most one pointer per level of nesting) would ever produce, and
+// exists only to guarantee termination on a corrupt or hostile file.
+const maxPointerChainDepth = 32
+
+// readValue is readDataType's pointer-aware counterpart, used when
+// decoding an existing database's data section, where repeated values
+// are pointers (see pointer.go). resolve is called with the absolute
+// offset a pointer targets; readValue recurses into the bytes it
+// returns to decode the pointed-to value. The returned byte count is
+// always the length of the pointer itself, never of the value it
+// points to, matching how a sequential reader would skip over it.
+func readValue(b []byte, resolve resolver) (DataType, int, error) {
+	return readValueChasing(b, resolve, 0)
+}
+
+// readValueChasing is readValue's implementation. depth counts the
+// pointers already followed on the way to b, including those followed
+// to reach an enclosing Map or Slice (its elements inherit depth), so a
+// self- or mutually-referential pointer cycle is cut off whether it
+// loops straight through pointers or passes through a Map or Slice.
+func readValueChasing(b []byte, resolve resolver, depth int) (DataType, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+
+	if typeNum(b[0]>>5) == typeNumPointer {
+		if resolve == nil {
+			return nil, 0, errors.New("unexpected pointer while decoding a pointer-free section")
+		}
+		if depth >= maxPointerChainDepth {
+			return nil, 0, errors.New("too many chained pointers (possible cycle)")
+		}
+		offset, consumed, err := decodePointerValue(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		target, err := resolve(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := readValueChasing(target, resolve, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		return value, consumed, nil
+	}
+
+	tn, size, headerLen, err := readCtrlByte(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	body := b[headerLen:]
+
+	switch tn {
+	case typeNumMap:
+		m := make(Map, size)
+		consumed := headerLen
+		for i := 0; i < size; i++ {
+			key, n, err := readValueChasing(b[consumed:], resolve, depth)
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "error reading map key")
+			}
+			k, ok := key.(String)
+			if !ok {
+				return nil, 0, errors.Errorf("map key has type %T, not String", key)
+			}
+			consumed += n
+
+			value, n, err := readValueChasing(b[consumed:], resolve, depth)
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "error reading map value")
+			}
+			consumed += n
+
+			m[k] = value
+		}
+		return m, consumed, nil
+	case typeNumSlice:
+		s := make(Slice, 0, size)
+		consumed := headerLen
+		for i := 0; i < size; i++ {
+			value, n, err := readValueChasing(b[consumed:], resolve, depth)
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "error reading slice element")
+			}
+			consumed += n
+			s = append(s, value)
+		}
+		return s, consumed, nil
+	case typeNumString:
+		if len(body) < size {
+			return nil, 0, errors.New("truncated string value")
+		}
+		return String(body[:size]), headerLen + size, nil
+	case typeNumBytes:
+		if len(body) < size {
+			return nil, 0, errors.New("truncated bytes value")
+		}
+		v := make(Bytes, size)
+		copy(v, body[:size])
+		return v, headerLen + size, nil
+	case typeNumBool:
+		return Bool(size != 0), headerLen, nil
+	case typeNumUint16:
+		v, err := readUint(body, size)
+		return Uint16(v), headerLen + size, err
+	case typeNumUint32:
+		v, err := readUint(body, size)
+		return Uint32(v), headerLen + size, err
+	case typeNumInt32:
+		v, err := readUint(body, size)
+		return Int32(int32(v)), headerLen + size, err
+	case typeNumUint64:
+		v, err := readUint(body, size)
+		return Uint64(v), headerLen + size, err
+	case typeNumUint128:
+		if len(body) < size {
+			return nil, 0, errors.New("truncated uint128 value")
+		}
+		v := Uint128(*new(big.Int).SetBytes(body[:size]))
+		return &v, headerLen + size, nil
+	case typeNumFloat32:
+		if len(body) < 4 {
+			return nil, 0, errors.New("truncated float32 value")
+		}
+		return Float32(math.Float32frombits(binary.BigEndian.Uint32(body))), headerLen + 4, nil
+	case typeNumFloat64:
+		if len(body) < 8 {
+			return nil, 0, errors.New("truncated float64 value")
+		}
+		return Float64(math.Float64frombits(binary.BigEndian.Uint64(body))), headerLen + 8, nil
+	default:
+		return nil, 0, errors.Errorf("unsupported type number %d", tn)
+	}
+}
+
+func readUint(b []byte, size int) (uint64, error) {
+	if len(b) < size {
+		return 0, errors.New("truncated integer value")
+	}
+	var v uint64
+	for i := 0; i < size; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
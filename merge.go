@@ -0,0 +1,163 @@
+package mmdbwriter
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// MergeStrategy determines how the value being inserted for a network is
+// combined with any value already present for that network (or for a
+// descendant of it). It is used by Tree.InsertMergeWith.
+type MergeStrategy interface {
+	// Merge returns the value to store given the record's existing value,
+	// existing, and the value being inserted, value. existing is nil if
+	// the record previously had no value.
+	Merge(existing, value DataType) (DataType, error)
+}
+
+// ReplaceStrategy is a MergeStrategy that discards the existing value and
+// always stores the newly inserted value. This is the strategy used by
+// Tree.Insert.
+type ReplaceStrategy struct{}
+
+// Merge implements the MergeStrategy interface.
+func (ReplaceStrategy) Merge(_, value DataType) (DataType, error) {
+	return value, nil
+}
+
+// TopLevelMapMergeStrategy is a MergeStrategy for Map values. It
+// merges the existing and new maps by combining their top-level keys,
+// with the new map's values taking precedence on conflict. Nested maps
+// are not merged; use DeepMapMergeStrategy for that.
+type TopLevelMapMergeStrategy struct{}
+
+// Merge implements the MergeStrategy interface.
+func (TopLevelMapMergeStrategy) Merge(existing, value DataType) (DataType, error) {
+	if existing == nil {
+		return value, nil
+	}
+
+	existingMap, ok := existing.(Map)
+	if !ok {
+		return nil, errors.Errorf(
+			"TopLevelMapMergeStrategy requires the existing value to be a Map, got %T",
+			existing,
+		)
+	}
+	newMap, ok := value.(Map)
+	if !ok {
+		return nil, errors.Errorf(
+			"TopLevelMapMergeStrategy requires the new value to be a Map, got %T",
+			value,
+		)
+	}
+
+	merged := make(Map, len(existingMap)+len(newMap))
+	for k, v := range existingMap {
+		merged[k] = v
+	}
+	for k, v := range newMap {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// SliceMergeMode controls how DeepMapMergeStrategy combines two Slice
+// values found at the same key.
+type SliceMergeMode int
+
+const (
+	// SliceConcat appends the new slice's elements to the existing
+	// slice's elements, keeping duplicates.
+	SliceConcat SliceMergeMode = iota
+
+	// SliceUnion appends only the elements of the new slice that are not
+	// already present (by deep equality) in the existing slice.
+	SliceUnion
+)
+
+// DeepMapMergeStrategy is a MergeStrategy that recursively merges
+// Map values key by key. Where both the existing and new value
+// at a key are Maps, they are merged recursively. Where both are Slices,
+// they are combined according to SliceMergeMode. Anywhere else, the new
+// value replaces the existing one, provided the two are of the same
+// type; a type mismatch at a leaf is an error.
+type DeepMapMergeStrategy struct {
+	SliceMergeMode SliceMergeMode
+}
+
+// Merge implements the MergeStrategy interface.
+func (s DeepMapMergeStrategy) Merge(existing, value DataType) (DataType, error) {
+	return s.merge(existing, value)
+}
+
+func (s DeepMapMergeStrategy) merge(existing, value DataType) (DataType, error) {
+	if existing == nil {
+		return value, nil
+	}
+	if value == nil {
+		return existing, nil
+	}
+
+	switch newValue := value.(type) {
+	case Map:
+		existingValue, ok := existing.(Map)
+		if !ok {
+			return nil, errors.Errorf("cannot merge Map into %T", existing)
+		}
+		return s.mergeMaps(existingValue, newValue)
+	case Slice:
+		existingValue, ok := existing.(Slice)
+		if !ok {
+			return nil, errors.Errorf("cannot merge Slice into %T", existing)
+		}
+		return s.mergeSlices(existingValue, newValue), nil
+	default:
+		if reflect.TypeOf(existing) != reflect.TypeOf(value) {
+			return nil, errors.Errorf("cannot merge %T into %T", value, existing)
+		}
+		return value, nil
+	}
+}
+
+func (s DeepMapMergeStrategy) mergeMaps(existing, value Map) (Map, error) {
+	merged := make(Map, len(existing)+len(value))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range value {
+		if existingValue, ok := merged[k]; ok {
+			mergedValue, err := s.merge(existingValue, v)
+			if err != nil {
+				return nil, errors.Wrapf(err, `error merging key "%s"`, k)
+			}
+			merged[k] = mergedValue
+			continue
+		}
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+func (s DeepMapMergeStrategy) mergeSlices(existing, value Slice) Slice {
+	merged := make(Slice, len(existing), len(existing)+len(value))
+	copy(merged, existing)
+
+	for _, v := range value {
+		if s.SliceMergeMode == SliceUnion {
+			duplicate := false
+			for _, e := range existing {
+				if reflect.DeepEqual(e, v) {
+					duplicate = true
+					break
+				}
+			}
+			if duplicate {
+				continue
+			}
+		}
+		merged = append(merged, v)
+	}
+	return merged
+}
@@ -4,7 +4,6 @@ import (
 	"net"
 	"reflect"
 
-	"github.com/maxmind/mmdbwriter/mmdbtype"
 	"github.com/pkg/errors"
 )
 
@@ -21,7 +20,7 @@ const (
 
 type record struct {
 	node       *node
-	value      mmdbtype.DataType
+	value      DataType
 	recordType recordType
 }
 
@@ -35,7 +34,7 @@ func (n *node) insert(
 	ip net.IP,
 	prefixLen int,
 	recordType recordType,
-	inserter func(value mmdbtype.DataType) (mmdbtype.DataType, error),
+	inserter func(value DataType) (DataType, error),
 	insertedNode *node,
 	currentDepth int,
 ) error {
@@ -61,14 +60,22 @@ func (r *record) insert(
 	ip net.IP,
 	prefixLen int,
 	recordType recordType,
-	inserter func(value mmdbtype.DataType) (mmdbtype.DataType, error),
+	inserter func(value DataType) (DataType, error),
 	insertedNode *node,
 	newDepth int,
 ) error {
 	switch r.recordType {
 	case recordTypeNode, recordTypeFixedNode:
 	case recordTypeEmpty, recordTypeData:
-		// When we add record merging support, it should go here.
+		// inserter is called with the record's existing value (nil if
+		// there is none) and returns the value to store. This is also
+		// how record merging is implemented: Tree.InsertMergeWith wraps a
+		// MergeStrategy in an inserter that combines the existing and new
+		// values instead of simply replacing one with the other. Because
+		// we recurse all the way down to each leaf record rather than
+		// stopping at the first one reached, a wider network inserted
+		// over several narrower ones applies the strategy at every
+		// descendant record, not just at the insertion point.
 		if newDepth >= prefixLen {
 			r.node = insertedNode
 			r.recordType = recordType
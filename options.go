@@ -0,0 +1,47 @@
+package mmdbwriter
+
+// Options allows the customization of the tree and the way it is written
+// out as an mmdb file.
+type Options struct {
+	// DatabaseType is a string that indicates the structure of each data
+	// record associated with an IP address. The MaxMind specific
+	// GeoIP2-City database has a type of "GeoIP2-City". Custom database
+	// types should use a unique name not used by MaxMind.
+	DatabaseType string
+
+	// RecordSize is the record size in bits. Valid values are 24, 28, or
+	// 32. This is only used when the tree is written out, not when it is
+	// read in, as the record size is determined by the metadata.
+	RecordSize int
+
+	// IPVersion is the IP version used in the database (4 or 6).
+	IPVersion int
+
+	// Languages is a slice of strings, each of which is a locale code. Any
+	// description supplied should at least include the languages in this
+	// list.
+	Languages []string
+
+	// Description is a map where the key is a language code and the value
+	// is a description in that language.
+	Description map[string]string
+
+	// DisableIPv4Aliasing is kept with the tree's options but is not read
+	// by any Tree method: a Tree never aliases IPv4 networks to their
+	// IPv6 equivalents itself, whatever its value.
+	DisableIPv4Aliasing bool
+
+	// IncludeReservedNetworks is kept with the tree's options but is not
+	// read by any Tree method: New inserts no reserved networks, whatever
+	// its value. A network is reserved only through
+	// Tree.InsertReservedNetwork.
+	IncludeReservedNetworks bool
+
+	// DisablePointers disables the use of the data section pointer type
+	// when writing out the database, causing every value to be written
+	// out in full each time it occurs. This is only useful for debugging,
+	// e.g., producing output that is simpler to diff by hand, and will
+	// substantially increase the size of databases with a lot of repeated
+	// data, such as geolocation databases.
+	DisablePointers bool
+}
@@ -0,0 +1,182 @@
+package mmdbwriter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pointer size thresholds and biases, as defined by the MaxMind DB format
+// spec for the four pointer sub-encodings.
+const (
+	pointerSize0Max  = 1 << 11
+	pointerSize1Max  = 1<<19 + 2048
+	pointerSize2Max  = 1<<27 + 526336
+	pointerSize1Bias = 2048
+	pointerSize2Bias = 526336
+)
+
+// writeWithDedup writes t to w, emitting a pointer to a previously written
+// occurrence of an equal value instead of writing it out a second time.
+// inline does the actual encoding of t the first time it is seen. Only
+// composite and variable-length types (Map, Slice, String, Bytes) are
+// eligible for interning; everything else is always written inline.
+func writeWithDedup(
+	w writer,
+	t DataType,
+	inline func(writer) (int64, error),
+) (int64, error) {
+	key, ok := dedupKey(t)
+	if !ok {
+		return inline(w)
+	}
+
+	if offset, found := w.internedOffset(key); found {
+		return writePointer(w, offset)
+	}
+
+	start := w.offset()
+	numBytes, err := inline(w)
+	if err != nil {
+		return numBytes, err
+	}
+	w.intern(key, start)
+	return numBytes, nil
+}
+
+// dedupKey returns a canonical string identifying t's content and true if
+// t is a type we are willing to intern. Two values that compare equal
+// (deep equality for Map and Slice, byte equality for String and Bytes)
+// always produce the same key.
+func dedupKey(t DataType) (string, bool) {
+	switch t.(type) {
+	case Map, Slice, String, Bytes:
+		var b strings.Builder
+		writeDedupKey(&b, t)
+		return b.String(), true
+	default:
+		return "", false
+	}
+}
+
+func writeDedupKey(b *strings.Builder, t DataType) {
+	switch v := t.(type) {
+	case Map:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+
+		b.WriteByte('M')
+		for _, k := range keys {
+			fmt.Fprintf(b, "%d:%s", len(k), k)
+			writeDedupKey(b, v[String(k)])
+		}
+		b.WriteByte('e')
+	case Slice:
+		b.WriteByte('L')
+		for _, e := range v {
+			writeDedupKey(b, e)
+		}
+		b.WriteByte('e')
+	case String:
+		fmt.Fprintf(b, "S%d:%s", len(v), string(v))
+	case Bytes:
+		fmt.Fprintf(b, "B%d:", len(v))
+		b.Write(v)
+	default:
+		// Scalars are cheap enough to write inline every time, so
+		// dedupKey never interns one on its own, but they are reached
+		// here as the values and elements of a Map or Slice.
+		fmt.Fprintf(b, "%T:%v", v, v)
+	}
+}
+
+// writePointer writes a pointer to the value previously written at
+// offset, using the smallest of the four pointer sub-encodings that can
+// represent it.
+func writePointer(w writer, offset int64) (int64, error) {
+	if offset < 0 || offset > math.MaxUint32 {
+		return 0, errors.Errorf("cannot point to data section offset %d", offset)
+	}
+
+	var size, leadingBits byte
+	var value uint32
+	switch {
+	case offset < pointerSize0Max:
+		size = 0
+		value = uint32(offset)
+	case offset < pointerSize1Max:
+		size = 1
+		value = uint32(offset) - pointerSize1Bias
+	case offset < pointerSize2Max:
+		size = 2
+		value = uint32(offset) - pointerSize2Bias
+	default:
+		size = 3
+		value = uint32(offset)
+	}
+
+	numValueBytes := int(size) + 1
+	if size < 3 {
+		// For sizes 0-2, the top 0-3 bits of the value are packed into the
+		// control byte itself alongside the pointer type and size.
+		leadingBits = byte((value >> (8 * uint(numValueBytes))) & 0x7)
+	}
+
+	ctrl := byte(typeNumPointer<<5) | (size << 3) | leadingBits
+	if err := w.WriteByte(ctrl); err != nil {
+		return 0, errors.Wrapf(err, "error writing pointer control byte (offset: %d)", offset)
+	}
+	numBytes := int64(1)
+
+	for i := numValueBytes; i > 0; i-- {
+		err := w.WriteByte(byte((value >> (8 * uint(i-1))) & 0xFF))
+		if err != nil {
+			return numBytes, errors.Wrapf(err, "error writing pointer value (offset: %d)", offset)
+		}
+		numBytes++
+	}
+	return numBytes, nil
+}
+
+// decodePointerValue decodes the data section offset encoded by the
+// pointer at the front of b, along with the number of bytes the pointer
+// itself occupies. It is the inverse of writePointer.
+func decodePointerValue(b []byte) (int, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errors.New("unexpected end of data while reading pointer")
+	}
+
+	ctrl := b[0]
+	size := (ctrl >> 3) & 0x3
+	leading := uint32(ctrl & 0x7)
+	numValueBytes := int(size) + 1
+
+	if len(b) < 1+numValueBytes {
+		return 0, 0, errors.New("truncated pointer")
+	}
+
+	var value uint32
+	if size < 3 {
+		value = leading
+	}
+	for i := 1; i <= numValueBytes; i++ {
+		value = value<<8 | uint32(b[i])
+	}
+
+	switch size {
+	case 0:
+		return int(value), 2, nil
+	case 1:
+		return int(value + pointerSize1Bias), 3, nil
+	case 2:
+		return int(value + pointerSize2Bias), 4, nil
+	default:
+		return int(value), 5, nil
+	}
+}
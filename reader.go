@@ -0,0 +1,427 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// metadataStartMarker precedes the metadata section in every mmdb file.
+var metadataStartMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSectionSeparatorSize is the width, in bytes, of the all-zero
+// padding this library writes between the tree section and the data
+// section (see Tree.WriteTo). Load uses it both to locate the data
+// section and, by verifying it really is all zeros, as a sanity check
+// on the record_size/node_count values taken from the metadata.
+const dataSectionSeparatorSize = 16
+
+// reservedNetworksMetadataKey is a vendor-prefixed metadata field this
+// library writes alongside the standard MaxMind DB fields, listing the
+// CIDRs inserted via Tree.InsertReservedNetwork. The standard mmdb
+// format has no way to tell a reserved (insert-rejecting) record apart
+// from a merely empty one once it is on disk, so Load has nothing else
+// to recover this distinction from.
+const reservedNetworksMetadataKey = "mmdbwriter.reserved_networks"
+
+// Load reads an existing mmdb file at path into a new, mutable Tree.
+// Insert, InsertFunc, InsertMergeWith, and WriteTo all work on the
+// result exactly as they would on a Tree built up from scratch, which
+// makes it possible to take a previously built database — one this
+// package produced, or one obtained elsewhere — and layer further
+// changes on top of it.
+//
+// Options fields that describe the file's own structure (RecordSize,
+// IPVersion, DatabaseType, Languages, Description) are taken from the
+// file's metadata section and override whatever opts sets for them; the
+// rest of opts, such as DisablePointers, applies to how the Tree behaves
+// from here on.
+func Load(path string, opts Options) (*Tree, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", path)
+	}
+
+	metaStart, err := findMetadataStart(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// The metadata section is itself a Map, and the spec allows it to
+	// contain pointers the same as the data section does — offsets
+	// relative to metaStart rather than to a separate section start.
+	// Real MaxMind-shipped files can pointerize repeated metadata
+	// strings (e.g. description languages), so this cannot be decoded
+	// with the pointer-free readDataType used for the WAL.
+	metaResolve := func(offset int) ([]byte, error) {
+		if offset < 0 || metaStart+offset >= len(raw) {
+			return nil, errors.Errorf("metadata pointer offset %d is out of range", offset)
+		}
+		return raw[metaStart+offset:], nil
+	}
+	metaValue, _, err := readValue(raw[metaStart:], metaResolve)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding metadata section")
+	}
+	meta, ok := metaValue.(Map)
+	if !ok {
+		return nil, errors.Errorf("metadata section is a %T, not a Map", metaValue)
+	}
+
+	recordSize, err := metaUint(meta, "record_size")
+	if err != nil {
+		return nil, err
+	}
+	ipVersion, err := metaUint(meta, "ip_version")
+	if err != nil {
+		return nil, err
+	}
+	nodeCount, err := metaUint(meta, "node_count")
+	if err != nil {
+		return nil, err
+	}
+
+	opts.RecordSize = int(recordSize)
+	opts.IPVersion = int(ipVersion)
+	if databaseType, err := metaString(meta, "database_type"); err == nil {
+		opts.DatabaseType = databaseType
+	}
+	if languages, ok := meta[String("languages")].(Slice); ok {
+		opts.Languages = nil
+		for _, l := range languages {
+			if s, ok := l.(String); ok {
+				opts.Languages = append(opts.Languages, string(s))
+			}
+		}
+	}
+	if description, ok := meta[String("description")].(Map); ok {
+		opts.Description = make(map[string]string, len(description))
+		for k, v := range description {
+			if s, ok := v.(String); ok {
+				opts.Description[string(k)] = string(s)
+			}
+		}
+	}
+
+	nodeByteSize, err := nodeByteSizeFor(int(recordSize))
+	if err != nil {
+		return nil, err
+	}
+	treeSectionSize := int(nodeCount) * nodeByteSize
+	dataSectionStart := treeSectionSize + dataSectionSeparatorSize
+
+	if dataSectionStart > metaStart {
+		return nil, errors.Errorf(
+			"node_count (%d) and record_size (%d) in the metadata imply a tree"+
+				" section larger than the file", nodeCount, recordSize,
+		)
+	}
+	separator := raw[treeSectionSize:dataSectionStart]
+	if !bytes.Equal(separator, make([]byte, dataSectionSeparatorSize)) {
+		return nil, errors.New(
+			"tree/data separator is not zero-filled; node_count or" +
+				" record_size in the metadata do not match the file",
+		)
+	}
+	dataSection := raw[dataSectionStart:metaStart]
+
+	t, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := loadTreeSection(
+		raw[:treeSectionSize],
+		dataSection,
+		int(nodeCount),
+		int(recordSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// node_count and record_size are taken from metadata and trusted to
+	// lay out the tree section (only the zero-filled separator is
+	// checked above). Cross-check them against the graph actually
+	// reconstructed: every node reachable from root should account for
+	// exactly node_count of the nodes loadTreeSection allocated.
+	if err := verifyNodeCount(root, int(nodeCount)); err != nil {
+		return nil, err
+	}
+	t.root = root
+
+	if err := retagKnownAliasNetworks(root, int(ipVersion)); err != nil {
+		return nil, err
+	}
+
+	if reservedNetworks, ok := meta[String(reservedNetworksMetadataKey)].(Slice); ok {
+		for _, v := range reservedNetworks {
+			s, ok := v.(String)
+			if !ok {
+				continue
+			}
+			_, network, err := net.ParseCIDR(string(s))
+			if err != nil {
+				return nil, errors.Wrapf(err, "error parsing reserved network %q from metadata", s)
+			}
+			if err := t.InsertReservedNetwork(network); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return t, nil
+}
+
+func findMetadataStart(raw []byte) (int, error) {
+	idx := bytes.LastIndex(raw, metadataStartMarker)
+	if idx < 0 {
+		return 0, errors.New("could not find metadata section; this does not look like an mmdb file")
+	}
+	return idx + len(metadataStartMarker), nil
+}
+
+func metaString(m Map, key string) (string, error) {
+	v, ok := m[String(key)]
+	if !ok {
+		return "", errors.Errorf("metadata is missing %q", key)
+	}
+	s, ok := v.(String)
+	if !ok {
+		return "", errors.Errorf("metadata %q has type %T, not String", key, v)
+	}
+	return string(s), nil
+}
+
+func metaUint(m Map, key string) (uint64, error) {
+	v, ok := m[String(key)]
+	if !ok {
+		return 0, errors.Errorf("metadata is missing %q", key)
+	}
+	switch n := v.(type) {
+	case Uint16:
+		return uint64(n), nil
+	case Uint32:
+		return uint64(n), nil
+	case Uint64:
+		return uint64(n), nil
+	default:
+		return 0, errors.Errorf("metadata %q has type %T, not an unsigned integer", key, v)
+	}
+}
+
+func nodeByteSizeFor(recordSize int) (int, error) {
+	switch recordSize {
+	case 24, 28, 32:
+		return recordSize * 2 / 8, nil
+	default:
+		return 0, errors.Errorf("unsupported record_size %d", recordSize)
+	}
+}
+
+// loadTreeSection decodes the on-disk search tree into a graph of *node
+// values and returns the root (node 0). A record whose value equals
+// nodeCount is empty; a value less than nodeCount is a pointer to
+// another node, reconstructing any node that is shared between several
+// parents as an ordinary recordTypeNode, since the on-disk format has no
+// way to tell an alias apart from any other shared subtree; a value
+// greater than nodeCount points into the data section. Load retags the
+// records for known alias networks afterward; see
+// retagKnownAliasNetworks.
+func loadTreeSection(
+	treeSection, dataSection []byte,
+	nodeCount, recordSize int,
+) (*node, error) {
+	nodes := make([]*node, nodeCount)
+	for i := range nodes {
+		nodes[i] = &node{nodeNum: i}
+	}
+
+	resolve := func(offset int) ([]byte, error) {
+		if offset < 0 || offset >= len(dataSection) {
+			return nil, errors.Errorf("data pointer offset %d is out of range", offset)
+		}
+		return dataSection[offset:], nil
+	}
+
+	for i, n := range nodes {
+		r0, r1, err := readNodeRecords(treeSection, i, recordSize)
+		if err != nil {
+			return nil, err
+		}
+		for which, v := range [2]uint32{r0, r1} {
+			rec, err := decodeRecord(v, nodes, dataSection, nodeCount, resolve)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error decoding node %d record %d", i, which)
+			}
+			n.children[which] = rec
+		}
+	}
+
+	if nodeCount == 0 {
+		return &node{}, nil
+	}
+	return nodes[0], nil
+}
+
+func decodeRecord(
+	value uint32,
+	nodes []*node,
+	dataSection []byte,
+	nodeCount int,
+	resolve resolver,
+) (record, error) {
+	switch {
+	case int(value) == nodeCount:
+		return record{recordType: recordTypeEmpty}, nil
+	case int(value) < nodeCount:
+		return record{recordType: recordTypeNode, node: nodes[value]}, nil
+	default:
+		offset := int(value) - nodeCount - dataSectionSeparatorSize
+		if offset < 0 || offset >= len(dataSection) {
+			return record{}, errors.Errorf("data offset %d is out of range", offset)
+		}
+		v, _, err := readValue(dataSection[offset:], resolve)
+		if err != nil {
+			return record{}, errors.Wrap(err, "error decoding data record")
+		}
+		return record{recordType: recordTypeData, value: v}, nil
+	}
+}
+
+// readNodeRecords decodes the two records packed into node i of
+// treeSection.
+func readNodeRecords(treeSection []byte, i, recordSize int) (uint32, uint32, error) {
+	nodeByteSize, err := nodeByteSizeFor(recordSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := i * nodeByteSize
+	if start+nodeByteSize > len(treeSection) {
+		return 0, 0, errors.Errorf("node %d is out of range", i)
+	}
+	b := treeSection[start : start+nodeByteSize]
+
+	switch recordSize {
+	case 24:
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]),
+			uint32(b[3])<<16 | uint32(b[4])<<8 | uint32(b[5]),
+			nil
+	case 28:
+		middle := b[3]
+		r0 := uint32(middle>>4)<<24 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		r1 := uint32(middle&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+		return r0, r1, nil
+	case 32:
+		return binary.BigEndian.Uint32(b[0:4]), binary.BigEndian.Uint32(b[4:8]), nil
+	default:
+		return 0, 0, errors.Errorf("unsupported record_size %d", recordSize)
+	}
+}
+
+// knownAliasNetworks are the IPv6 networks that only ever alias the
+// embedded IPv4 subtree — never its primary storage location. Notably,
+// ::ffff:0:0/96 is NOT one of these: it is where IPv4 data actually
+// lives in a v6 database (IPv4-mapped lookups resolve there), so its
+// record must stay a recordTypeNode. node.finalize does not traverse
+// recordTypeAlias children, so retagging the primary location would
+// leave its entire subtree unnumbered, and r.insert's recordTypeAlias
+// case would reject every IPv4 insert outright. These, by contrast,
+// really are alternate routes to the same subtree and are safe to
+// retag.
+var knownAliasNetworks = []string{
+	"2002::/16", // 6to4
+	"2001::/32", // Teredo
+}
+
+// retagKnownAliasNetworks changes the recordType of the record at each
+// of knownAliasNetworks, if present in root, from recordTypeNode to
+// recordTypeAlias. loadTreeSection has no way to distinguish an alias
+// from any other node shared between two parents, so without this a
+// genuinely aliased range loaded from disk would be treated as an
+// ordinary node: inserting into it would corrupt whatever else shares
+// that *node, via r.insert's recordTypeNode case, and a later WriteTo
+// would duplicate the subtree instead of re-aliasing it.
+func retagKnownAliasNetworks(root *node, ipVersion int) error {
+	if ipVersion != 6 {
+		return nil
+	}
+	for _, cidr := range knownAliasNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.Wrapf(err, "internal error: invalid alias CIDR %q", cidr)
+		}
+		r, err := findRecord(root, network.IP, prefixLenOf(network))
+		if err != nil {
+			// Not every file embeds the IPv4 subtree at every known
+			// alias location (e.g. DisableIPv4Aliasing, or an IPv4-only
+			// database); nothing to retag.
+			continue
+		}
+		if r.recordType == recordTypeNode {
+			r.recordType = recordTypeAlias
+		}
+	}
+	return nil
+}
+
+// findRecord walks root down exactly prefixLen bits, following network's
+// address, and returns a pointer to the record found there so callers
+// can modify it in place.
+func findRecord(root *node, ip net.IP, prefixLen int) (*record, error) {
+	if prefixLen <= 0 {
+		return nil, errors.Errorf("invalid prefix length %d", prefixLen)
+	}
+
+	n := root
+	for depth := 0; ; depth++ {
+		r := &n.children[bitAt(ip, depth)]
+		if depth == prefixLen-1 {
+			return r, nil
+		}
+
+		switch r.recordType {
+		case recordTypeNode, recordTypeAlias, recordTypeFixedNode:
+			n = r.node
+		default:
+			return nil, errors.Errorf("no node found at the expected depth for %s/%d", ip, prefixLen)
+		}
+	}
+}
+
+// verifyNodeCount walks every node reachable from root and confirms the
+// count matches nodeCount, the node_count metadata value loadTreeSection
+// used to size and index its node array. The two would disagree if the
+// metadata were corrupt or simply wrong about the file it is attached
+// to; the zero-filled separator check on its own only catches a
+// record_size/node_count combination that produces the wrong tree
+// section length, not one that happens to produce the right length with
+// the wrong structure.
+func verifyNodeCount(root *node, nodeCount int) error {
+	visited := make(map[*node]bool, nodeCount)
+	var walk func(n *node)
+	walk = func(n *node) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		for _, r := range n.children {
+			switch r.recordType {
+			case recordTypeNode, recordTypeAlias, recordTypeFixedNode:
+				walk(r.node)
+			}
+		}
+	}
+	walk(root)
+
+	if len(visited) != nodeCount {
+		return errors.Errorf(
+			"reconstructed tree has %d reachable nodes, but metadata declares node_count of %d",
+			len(visited), nodeCount,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Tree represents a MaxMind DB search tree that can be written out as an
+// mmdb file.
+type Tree struct {
+	// mu guards every field below against concurrent access from
+	// Insert*, WriteTo, and the background WAL rotator, all of which
+	// read or mutate the tree (root.finalize, in particular, rewrites
+	// node and record state in place).
+	mu sync.Mutex
+
+	root      *node
+	opts      Options
+	treeDepth int
+
+	// reservedNetworks records the networks passed to
+	// InsertReservedNetwork, in insertion order, so WriteTo can persist
+	// them in the metadata section for Load to recover; see
+	// reservedNetworksMetadataKey.
+	reservedNetworks []*net.IPNet
+
+	// wal is non-nil once EnableWAL has been called, and causes every
+	// subsequent Insert* call to be appended to the log before it
+	// returns.
+	wal *wal
+}
+
+// New creates a new Tree for building a MaxMind DB.
+func New(opts Options) (*Tree, error) {
+	if opts.RecordSize == 0 {
+		opts.RecordSize = 28
+	}
+	if opts.IPVersion == 0 {
+		opts.IPVersion = 6
+	}
+	if opts.IPVersion != 4 && opts.IPVersion != 6 {
+		return nil, errors.Errorf("unsupported IPVersion: %d", opts.IPVersion)
+	}
+
+	treeDepth := 32
+	if opts.IPVersion == 6 {
+		treeDepth = 128
+	}
+
+	return &Tree{
+		root:      &node{},
+		opts:      opts,
+		treeDepth: treeDepth,
+	}, nil
+}
+
+// Insert associates value with network. Any existing value for network,
+// or for any more specific network contained within it, is replaced.
+func (t *Tree) Insert(network *net.IPNet, value DataType) error {
+	return t.InsertMergeWith(network, value, ReplaceStrategy{})
+}
+
+// InsertMergeWith associates network with the result of combining value
+// with the network's existing value (or each of its descendants'
+// existing values, if network is wider than networks already in the
+// tree) using strategy.
+func (t *Tree) InsertMergeWith(
+	network *net.IPNet,
+	value DataType,
+	strategy MergeStrategy,
+) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.insertDataLocked(network, func(existing DataType) (DataType, error) {
+		return strategy.Merge(existing, value)
+	}); err != nil {
+		return err
+	}
+	return t.wal.logInsert(network, value, strategyIDFor(strategy))
+}
+
+// InsertReservedNetwork marks network as reserved. Any existing value
+// for the network is removed, and any later attempt to insert into it
+// is rejected.
+func (t *Tree) InsertReservedNetwork(network *net.IPNet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.checkNetwork(network); err != nil {
+		return err
+	}
+
+	if err := t.root.insert(network.IP, prefixLenOf(network), recordTypeReserved, nil, nil, 0); err != nil {
+		return err
+	}
+	t.reservedNetworks = append(t.reservedNetworks, network)
+	return t.wal.logInsertReservedNetwork(network)
+}
+
+// InsertFunc associates network with the value returned by inserter.
+// inserter is called with the existing value for network, or nil if there
+// is none, and returns the value to store. A nil return value removes the
+// record.
+func (t *Tree) InsertFunc(
+	network *net.IPNet,
+	inserter func(value DataType) (DataType, error),
+) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.insertDataLocked(network, inserter); err != nil {
+		return err
+	}
+
+	if t.wal == nil {
+		return nil
+	}
+	// inserter's closure cannot be serialized, so the WAL instead logs
+	// the value it produces for a previously empty record; see the doc
+	// comment on wal.logInsertFunc for the resulting replay caveat.
+	value, err := inserter(nil)
+	if err != nil {
+		return errors.Wrap(err, "error determining WAL log value for InsertFunc")
+	}
+	return t.wal.logInsertFunc(network, value)
+}
+
+// insertDataLocked is the shared implementation behind Insert, InsertFunc,
+// and InsertMergeWith. It does not touch the WAL; callers log whatever
+// representation of the mutation is appropriate for them. Callers must
+// hold t.mu.
+func (t *Tree) insertDataLocked(
+	network *net.IPNet,
+	inserter func(value DataType) (DataType, error),
+) error {
+	if err := t.checkNetwork(network); err != nil {
+		return err
+	}
+	return t.root.insert(network.IP, prefixLenOf(network), recordTypeData, inserter, nil, 0)
+}
+
+func (t *Tree) checkNetwork(network *net.IPNet) error {
+	_, bits := network.Mask.Size()
+	if bits != t.treeDepth {
+		return errors.Errorf(
+			"cannot insert %s into a tree with IP version %d",
+			network,
+			t.opts.IPVersion,
+		)
+	}
+	return nil
+}
+
+func prefixLenOf(network *net.IPNet) int {
+	prefixLen, _ := network.Mask.Size()
+	return prefixLen
+}
+
+// dataWriter is the concrete writer used for the data section. It tracks
+// the current offset and, unless pointers are disabled, interns values so
+// repeated occurrences can be written as pointers instead of being
+// duplicated.
+type dataWriter struct {
+	bytes.Buffer
+	disablePointers bool
+	offsets         map[string]int64
+}
+
+func newDataWriter(disablePointers bool) *dataWriter {
+	return &dataWriter{offsets: map[string]int64{}, disablePointers: disablePointers}
+}
+
+func (w *dataWriter) offset() int64 {
+	return int64(w.Len())
+}
+
+func (w *dataWriter) internedOffset(key string) (int64, bool) {
+	if w.disablePointers {
+		return 0, false
+	}
+	offset, ok := w.offsets[key]
+	return offset, ok
+}
+
+func (w *dataWriter) intern(key string, offset int64) {
+	if w.disablePointers {
+		return
+	}
+	w.offsets[key] = offset
+}
+
+// WriteTo writes the tree out as an mmdb file to w.
+func (t *Tree) WriteTo(w io.Writer) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writeToLocked(w)
+}
+
+// writeToLocked is WriteTo's implementation. Callers must hold t.mu; this
+// lets the WAL rotator take a consistent snapshot of the tree (see
+// wal.maybeRotate) without going through WriteTo's own locking and
+// deadlocking on a mutex t.mu already holds.
+func (t *Tree) writeToLocked(w io.Writer) (int64, error) {
+	_, nodeCount := t.root.finalize(0)
+
+	dw := newDataWriter(t.opts.DisablePointers)
+	// The data section always starts with a single byte of padding, so
+	// no value is ever written at offset 0.
+	if err := dw.WriteByte(0); err != nil {
+		return 0, errors.Wrap(err, "error writing data section padding")
+	}
+
+	dataOffsets, err := t.writeDataSection(dw)
+	if err != nil {
+		return 0, err
+	}
+
+	var numBytes int64
+	written, err := t.writeTreeSection(w, nodeCount, dataOffsets)
+	numBytes += written
+	if err != nil {
+		return numBytes, err
+	}
+
+	// The tree/data separator required by the file format. Load relies
+	// on this being exactly dataSectionSeparatorSize zero bytes both to
+	// find the data section and as a sanity check on a file's metadata.
+	if err := writeBytes(w, &numBytes, make([]byte, dataSectionSeparatorSize)); err != nil {
+		return numBytes, err
+	}
+
+	written, err = dw.WriteTo(w)
+	numBytes += written
+	if err != nil {
+		return numBytes, errors.Wrap(err, "error writing data section")
+	}
+
+	metaWriter := newDataWriter(true)
+	if _, err := t.buildMetadata(nodeCount).writeTo(metaWriter); err != nil {
+		return numBytes, errors.Wrap(err, "error writing metadata section")
+	}
+	if err := writeBytes(w, &numBytes, metadataStartMarker); err != nil {
+		return numBytes, err
+	}
+	written, err = metaWriter.WriteTo(w)
+	numBytes += written
+	if err != nil {
+		return numBytes, errors.Wrap(err, "error writing metadata section")
+	}
+
+	return numBytes, nil
+}
+
+// buildMetadata assembles the metadata section map written at the end of
+// the file by WriteTo.
+func (t *Tree) buildMetadata(nodeCount int) Map {
+	languages := make(Slice, 0, len(t.opts.Languages))
+	for _, l := range t.opts.Languages {
+		languages = append(languages, String(l))
+	}
+
+	description := make(Map, len(t.opts.Description))
+	for k, v := range t.opts.Description {
+		description[String(k)] = String(v)
+	}
+
+	meta := Map{
+		"binary_format_major_version": Uint16(2),
+		"binary_format_minor_version": Uint16(0),
+		"database_type":               String(t.opts.DatabaseType),
+		"description":                 description,
+		"ip_version":                  Uint16(t.opts.IPVersion),
+		"languages":                   languages,
+		"node_count":                  Uint32(nodeCount),
+		"record_size":                 Uint16(t.opts.RecordSize),
+	}
+
+	if len(t.reservedNetworks) > 0 {
+		reserved := make(Slice, 0, len(t.reservedNetworks))
+		for _, n := range t.reservedNetworks {
+			reserved = append(reserved, String(n.String()))
+		}
+		meta[reservedNetworksMetadataKey] = reserved
+	}
+
+	return meta
+}
+
+// writeDataSection writes every data record reachable from the tree into
+// dw and returns a map from each data record to the offset of its value
+// within the data section.
+func (t *Tree) writeDataSection(dw *dataWriter) (map[*record]int64, error) {
+	offsets := map[*record]int64{}
+	var walk func(n *node) error
+	walk = func(n *node) error {
+		for i := range n.children {
+			r := &n.children[i]
+			switch r.recordType {
+			case recordTypeNode, recordTypeAlias, recordTypeFixedNode:
+				if err := walk(r.node); err != nil {
+					return err
+				}
+			case recordTypeData:
+				offset := dw.offset()
+				if _, err := r.value.writeTo(dw); err != nil {
+					return errors.Wrap(err, "error writing data record")
+				}
+				offsets[r] = offset
+			}
+		}
+		return nil
+	}
+	return offsets, walk(t.root)
+}
+
+// writeTreeSection writes the packed node records making up the search
+// tree. Each node contributes one RecordSize*2-bit entry, in order of
+// node number, so node 0 (the root) comes first.
+func (t *Tree) writeTreeSection(
+	w io.Writer,
+	nodeCount int,
+	dataOffsets map[*record]int64,
+) (int64, error) {
+	nodeByteSize, err := nodeByteSizeFor(t.opts.RecordSize)
+	if err != nil {
+		return 0, err
+	}
+
+	nodes, err := collectNodes(t.root, nodeCount)
+	if err != nil {
+		return 0, err
+	}
+
+	var numBytes int64
+	buf := make([]byte, nodeByteSize)
+	for _, n := range nodes {
+		r0, err := recordValue(&n.children[0], nodeCount, dataOffsets)
+		if err != nil {
+			return numBytes, err
+		}
+		r1, err := recordValue(&n.children[1], nodeCount, dataOffsets)
+		if err != nil {
+			return numBytes, err
+		}
+		if err := encodeNodeRecords(buf, t.opts.RecordSize, r0, r1); err != nil {
+			return numBytes, err
+		}
+		if err := writeBytes(w, &numBytes, buf); err != nil {
+			return numBytes, err
+		}
+	}
+	return numBytes, nil
+}
+
+// collectNodes returns every node reachable from root, indexed by its
+// (post-finalize) node number. It walks the tree rather than trusting
+// nodeCount alone so that a node reachable from more than one parent —
+// an alias, or any other shared subtree — is written exactly once, at
+// the position matching its final node number.
+func collectNodes(root *node, nodeCount int) ([]*node, error) {
+	nodes := make([]*node, nodeCount)
+	visited := make(map[*node]bool, nodeCount)
+
+	var walk func(n *node) error
+	walk = func(n *node) error {
+		if visited[n] {
+			return nil
+		}
+		visited[n] = true
+
+		if n.nodeNum < 0 || n.nodeNum >= nodeCount {
+			return errors.Errorf("node number %d is out of range [0, %d)", n.nodeNum, nodeCount)
+		}
+		nodes[n.nodeNum] = n
+
+		for i := range n.children {
+			switch n.children[i].recordType {
+			case recordTypeNode, recordTypeAlias, recordTypeFixedNode:
+				if err := walk(n.children[i].node); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+
+	for i, n := range nodes {
+		if n == nil {
+			return nil, errors.Errorf("node %d was never reached while walking the tree", i)
+		}
+	}
+	return nodes, nil
+}
+
+// recordValue computes the on-disk record value for r: a node number for
+// a node, alias, or fixed-node record; a data section offset for a data
+// record; and nodeCount itself, the sentinel for "no data", for anything
+// else. Reserved records have no dedicated on-disk representation and
+// are written identically to empty ones; see reservedNetworksMetadataKey
+// for how Load tells them apart again.
+func recordValue(r *record, nodeCount int, dataOffsets map[*record]int64) (uint32, error) {
+	switch r.recordType {
+	case recordTypeNode, recordTypeAlias, recordTypeFixedNode:
+		return uint32(r.node.nodeNum), nil
+	case recordTypeData:
+		offset, ok := dataOffsets[r]
+		if !ok {
+			return 0, errors.New("internal error: data record has no recorded offset")
+		}
+		value := int64(nodeCount) + dataSectionSeparatorSize + offset
+		if value > math.MaxUint32 {
+			return 0, errors.Errorf("data section offset %d exceeds the maximum record value", offset)
+		}
+		return uint32(value), nil
+	default:
+		return uint32(nodeCount), nil
+	}
+}
+
+// encodeNodeRecords packs r0 and r1 into buf at RecordSize bits apiece,
+// mirroring readNodeRecords.
+func encodeNodeRecords(buf []byte, recordSize int, r0, r1 uint32) error {
+	switch recordSize {
+	case 24:
+		buf[0], buf[1], buf[2] = byte(r0>>16), byte(r0>>8), byte(r0)
+		buf[3], buf[4], buf[5] = byte(r1>>16), byte(r1>>8), byte(r1)
+	case 28:
+		buf[0], buf[1], buf[2] = byte(r0>>16), byte(r0>>8), byte(r0)
+		buf[3] = byte(r0>>24)<<4 | byte(r1>>24)
+		buf[4], buf[5], buf[6] = byte(r1>>16), byte(r1>>8), byte(r1)
+	case 32:
+		binary.BigEndian.PutUint32(buf[0:4], r0)
+		binary.BigEndian.PutUint32(buf[4:8], r1)
+	default:
+		return errors.Errorf("unsupported record_size %d", recordSize)
+	}
+	return nil
+}
+
+func writeBytes(w io.Writer, numBytes *int64, b []byte) error {
+	written, err := w.Write(b)
+	*numBytes += int64(written)
+	if err != nil {
+		return errors.Wrap(err, "error writing to output")
+	}
+	return nil
+}
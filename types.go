@@ -14,7 +14,7 @@ type typeNum byte
 
 const (
 	typeNumExtended typeNum = iota
-	typeNumPointer          // nolint: deadcode, varcheck
+	typeNumPointer
 	typeNumString
 	typeNumFloat64
 	typeNumBytes
@@ -37,6 +37,19 @@ type writer interface {
 	io.Writer
 	WriteByte(byte) error
 	WriteString(string) (int, error)
+
+	// offset returns the number of bytes written so far.
+	offset() int64
+
+	// internedOffset returns the offset at which the value identified by
+	// key was previously written and true, or false if key has not been
+	// seen before. Callers use this to emit a pointer rather than writing
+	// the value a second time.
+	internedOffset(key string) (int64, bool)
+
+	// intern records that the value identified by key was written
+	// starting at offset, so that later occurrences can be pointed at it.
+	intern(key string, offset int64)
 }
 
 // DataType represents a MaxMind DB data type
@@ -76,6 +89,10 @@ func (t Bytes) typeNum() typeNum {
 }
 
 func (t Bytes) writeTo(w writer) (int64, error) {
+	return writeWithDedup(w, t, t.writeToInline)
+}
+
+func (t Bytes) writeToInline(w writer) (int64, error) {
 	numBytes, err := writeCtrlByte(w, t)
 	if err != nil {
 		return numBytes, err
@@ -177,6 +194,10 @@ func (t Map) typeNum() typeNum {
 }
 
 func (t Map) writeTo(w writer) (int64, error) {
+	return writeWithDedup(w, t, t.writeToInline)
+}
+
+func (t Map) writeToInline(w writer) (int64, error) {
 	numBytes, err := writeCtrlByte(w, t)
 	if err != nil {
 		return numBytes, err
@@ -220,6 +241,10 @@ func (t Slice) typeNum() typeNum {
 }
 
 func (t Slice) writeTo(w writer) (int64, error) {
+	return writeWithDedup(w, t, t.writeToInline)
+}
+
+func (t Slice) writeToInline(w writer) (int64, error) {
 	numBytes, err := writeCtrlByte(w, t)
 	if err != nil {
 		return numBytes, err
@@ -247,6 +272,10 @@ func (t String) typeNum() typeNum {
 }
 
 func (t String) writeTo(w writer) (int64, error) {
+	return writeWithDedup(w, t, t.writeToInline)
+}
+
+func (t String) writeToInline(w writer) (int64, error) {
 	numBytes, err := writeCtrlByte(w, t)
 	if err != nil {
 		return numBytes, err
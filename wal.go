@@ -0,0 +1,732 @@
+package mmdbwriter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SyncPolicy controls when the WAL flushes and fsyncs a segment to disk.
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration
+}
+
+type syncMode int
+
+const (
+	syncAlways syncMode = iota
+	syncInterval
+	syncNever
+)
+
+// SyncAlways fsyncs the segment after every appended record. This is the
+// safest policy, and the default if no SyncPolicy is given, but it is
+// also the slowest.
+func SyncAlways() SyncPolicy {
+	return SyncPolicy{mode: syncAlways}
+}
+
+// SyncInterval fsyncs the segment at most once every d, batching any
+// records appended in between.
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{mode: syncInterval, interval: d}
+}
+
+// SyncNever never explicitly fsyncs the segment, relying on the OS to
+// flush it eventually. Records appended under this policy may be lost on
+// a crash, though not on a clean process exit.
+func SyncNever() SyncPolicy {
+	return SyncPolicy{mode: syncNever}
+}
+
+// WALOptions configures the write-ahead log enabled by Tree.EnableWAL.
+type WALOptions struct {
+	// SyncPolicy controls how often the WAL is fsynced. It defaults to
+	// SyncAlways.
+	SyncPolicy SyncPolicy
+
+	// MaxSegmentBytes is the approximate size at which the current
+	// segment is sealed, checkpointed to an .mmdb snapshot, and replaced
+	// with a new, empty segment. It defaults to 64 MiB.
+	MaxSegmentBytes int64
+
+	// RotateCheckInterval is how often the background rotator checks the
+	// current segment's size against MaxSegmentBytes. It defaults to 10
+	// seconds.
+	RotateCheckInterval time.Duration
+}
+
+func (o WALOptions) withDefaults() WALOptions {
+	if o.MaxSegmentBytes <= 0 {
+		o.MaxSegmentBytes = 64 << 20
+	}
+	if o.RotateCheckInterval <= 0 {
+		o.RotateCheckInterval = 10 * time.Second
+	}
+	return o
+}
+
+// mutationKind identifies the logical operation a WAL record encodes.
+type mutationKind byte
+
+const (
+	mutationInsert mutationKind = iota + 1
+	mutationInsertReservedNetwork
+)
+
+// strategyID identifies a MergeStrategy compactly enough to fit in a WAL
+// record. Only the strategies built into this package can be logged;
+// InsertMergeWith calls using a caller-defined MergeStrategy are logged
+// with strategyReplace and the inserted value, so replay stores that
+// value as is rather than merging it. InsertFunc calls are also logged
+// with strategyReplace (see the doc comment on wal.logInsertFunc).
+type strategyID byte
+
+const (
+	strategyReplace strategyID = iota
+	strategyTopLevelMap
+	strategyDeepMapConcat
+	strategyDeepMapUnion
+)
+
+func strategyIDFor(strategy MergeStrategy) strategyID {
+	switch s := strategy.(type) {
+	case TopLevelMapMergeStrategy:
+		return strategyTopLevelMap
+	case DeepMapMergeStrategy:
+		if s.SliceMergeMode == SliceUnion {
+			return strategyDeepMapUnion
+		}
+		return strategyDeepMapConcat
+	default:
+		return strategyReplace
+	}
+}
+
+func (id strategyID) strategy() MergeStrategy {
+	switch id {
+	case strategyTopLevelMap:
+		return TopLevelMapMergeStrategy{}
+	case strategyDeepMapConcat:
+		return DeepMapMergeStrategy{SliceMergeMode: SliceConcat}
+	case strategyDeepMapUnion:
+		return DeepMapMergeStrategy{SliceMergeMode: SliceUnion}
+	default:
+		return ReplaceStrategy{}
+	}
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// wal is the write-ahead log attached to a Tree by Tree.EnableWAL.
+type wal struct {
+	mu   sync.Mutex
+	dir  string
+	opts WALOptions
+
+	segment      *os.File
+	segmentBytes int64
+	nextSegment  int
+
+	pendingSync bool
+	lastSync    time.Time
+
+	stop chan struct{}
+
+	// rotateErrMu guards rotateErr, the result of the most recent
+	// background rotation attempt. It is reported through
+	// Tree.WALRotateError since there is no caller for the rotator
+	// goroutine to return it to directly.
+	rotateErrMu sync.Mutex
+	rotateErr   error
+}
+
+// EnableWAL attaches a write-ahead log at dir to t. Every subsequent
+// Insert, InsertFunc, InsertMergeWith, and InsertReservedNetwork call is
+// appended to the log before it returns, so the tree can be rebuilt with
+// LoadWAL after a crash. dir is created if it does not already exist.
+func (t *Tree) EnableWAL(dir string, opts WALOptions) error {
+	opts = opts.withDefaults()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrapf(err, "error creating WAL directory %s", dir)
+	}
+
+	segments, err := walSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	nextSegment := 0
+	if len(segments) > 0 {
+		nextSegment = segments[len(segments)-1] + 1
+	}
+
+	w := &wal{
+		dir:         dir,
+		opts:        opts,
+		nextSegment: nextSegment,
+		stop:        make(chan struct{}),
+	}
+	if err := w.openNewSegment(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.wal = w
+	t.mu.Unlock()
+	go w.rotator(t)
+	return nil
+}
+
+// DisableWAL stops the background rotator and flushes and closes the
+// current WAL segment, including under SyncInterval or SyncNever
+// policies that would otherwise leave the last batch of appends
+// unsynced. It is a no-op if no WAL is enabled. After it returns,
+// Insert* calls are no longer logged; call EnableWAL again to resume
+// logging, starting a new segment.
+func (t *Tree) DisableWAL() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w := t.wal
+	if w == nil {
+		return nil
+	}
+	close(w.stop)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.segment.Sync(); err != nil {
+		return errors.Wrap(err, "error syncing WAL segment")
+	}
+	if err := w.segment.Close(); err != nil {
+		return errors.Wrap(err, "error closing WAL segment")
+	}
+	t.wal = nil
+	return nil
+}
+
+// WALRotateError returns the error from the most recent background WAL
+// segment rotation triggered by MaxSegmentBytes, or nil if it succeeded,
+// none has been attempted yet, or no WAL is enabled. This is the only way
+// to observe a failed rotation short of inspecting the WAL directory,
+// since the rotator runs in its own goroutine with no caller to return to.
+func (t *Tree) WALRotateError() error {
+	t.mu.Lock()
+	w := t.wal
+	t.mu.Unlock()
+	if w == nil {
+		return nil
+	}
+	return w.lastRotateError()
+}
+
+func walSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading WAL directory %s", dir)
+	}
+
+	var segments []int
+	for _, e := range entries {
+		var n int
+		if _, err := fmt.Sscanf(e.Name(), "%06d.wal", &n); err == nil {
+			segments = append(segments, n)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (w *wal) segmentPath(n int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%06d.wal", n))
+}
+
+func (w *wal) openNewSegment() error {
+	f, err := os.OpenFile(
+		w.segmentPath(w.nextSegment),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		0o644,
+	)
+	if err != nil {
+		return errors.Wrap(err, "error creating WAL segment")
+	}
+	w.segment = f
+	w.segmentBytes = 0
+	w.nextSegment++
+	return nil
+}
+
+// logInsert appends a record encoding a Tree.Insert or
+// Tree.InsertMergeWith call to the log.
+func (w *wal) logInsert(network *net.IPNet, value DataType, sid strategyID) error {
+	if w == nil {
+		return nil
+	}
+
+	payload, err := encodeInsertPayload(network, value, sid)
+	if err != nil {
+		return err
+	}
+	return w.append(mutationInsert, payload)
+}
+
+// logInsertFunc appends a record for an InsertFunc call. Because an
+// arbitrary inserter closure cannot be serialized, the WAL stores the
+// value it returned when applied to a nil existing value, and replays it
+// with ReplaceStrategy. For inserters that behave like Tree.Insert (the
+// common case — overwrite with a fixed value) this replays faithfully.
+// For inserters that merge with the existing value, replay only
+// reproduces the result of the very first insert into each record; any
+// merging behavior that depends on what was already in the tree is lost.
+// Prefer Tree.InsertMergeWith with a MergeStrategy when WAL fidelity
+// matters.
+func (w *wal) logInsertFunc(network *net.IPNet, resultingValue DataType) error {
+	if w == nil {
+		return nil
+	}
+	return w.logInsert(network, resultingValue, strategyReplace)
+}
+
+// logInsertReservedNetwork appends a record encoding a
+// Tree.InsertReservedNetwork call to the log.
+func (w *wal) logInsertReservedNetwork(network *net.IPNet) error {
+	if w == nil {
+		return nil
+	}
+
+	payload, err := encodeNetworkPayload(network)
+	if err != nil {
+		return err
+	}
+	return w.append(mutationInsertReservedNetwork, payload)
+}
+
+func (w *wal) append(kind mutationKind, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	header := make([]byte, 9)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)+1))
+	header[4] = byte(kind)
+	crc := crc32.Update(0, crc32cTable, header[4:5])
+	crc = crc32.Update(crc, crc32cTable, payload)
+	binary.BigEndian.PutUint32(header[5:9], crc)
+
+	if _, err := w.segment.Write(header); err != nil {
+		return errors.Wrap(err, "error appending to WAL segment")
+	}
+	if _, err := w.segment.Write(payload); err != nil {
+		return errors.Wrap(err, "error appending to WAL segment")
+	}
+	w.segmentBytes += int64(len(header) + len(payload))
+
+	switch w.opts.SyncPolicy.mode {
+	case syncAlways:
+		return errors.Wrap(w.segment.Sync(), "error syncing WAL segment")
+	case syncInterval:
+		if time.Since(w.lastSync) >= w.opts.SyncPolicy.interval {
+			w.lastSync = time.Now()
+			return errors.Wrap(w.segment.Sync(), "error syncing WAL segment")
+		}
+		w.pendingSync = true
+	}
+	return nil
+}
+
+// rotator periodically checks whether the current segment has grown
+// past MaxSegmentBytes and, if so, seals it: it checkpoints t to a
+// snapshot .mmdb file, starts a new empty segment, and removes the
+// now-fully-replayed older segments.
+func (w *wal) rotator(t *Tree) {
+	ticker := time.NewTicker(w.opts.RotateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			err := w.maybeRotate(t)
+			w.rotateErrMu.Lock()
+			w.rotateErr = err
+			w.rotateErrMu.Unlock()
+		}
+	}
+}
+
+// lastRotateError returns the error from the most recent rotation
+// attempt, or nil if it succeeded (or none has run yet).
+func (w *wal) lastRotateError() error {
+	w.rotateErrMu.Lock()
+	defer w.rotateErrMu.Unlock()
+	return w.rotateErr
+}
+
+func (w *wal) maybeRotate(t *Tree) error {
+	w.mu.Lock()
+	size := w.segmentBytes
+	w.mu.Unlock()
+	if size < w.opts.MaxSegmentBytes {
+		return nil
+	}
+
+	// Hold the tree lock for the whole snapshot-and-rotate sequence.
+	// t.writeToLocked reads t.root via finalize, which mutates it in
+	// place (prunes and merges records, renumbers nodes); without this
+	// lock that races with any concurrent Insert*, which also mutates
+	// t.root. Holding it for the entire critical section, rather than
+	// just around the snapshot, also blocks Insert* (which holds the
+	// same lock around its own tree-mutate-then-log-append sequence)
+	// from appending a record that would land in the segment we are
+	// about to seal and delete but that the snapshot we just took does
+	// not contain.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w.mu.Lock()
+	size = w.segmentBytes
+	w.mu.Unlock()
+	if size < w.opts.MaxSegmentBytes {
+		// Another rotation already ran while we were waiting for t.mu.
+		return nil
+	}
+
+	snapshotPath := filepath.Join(w.dir, "checkpoint.mmdb.tmp")
+	f, err := os.Create(snapshotPath)
+	if err != nil {
+		return errors.Wrap(err, "error creating WAL checkpoint file")
+	}
+	_, writeErr := t.writeToLocked(f)
+	closeErr := f.Close()
+	if writeErr != nil {
+		os.Remove(snapshotPath)
+		return errors.Wrap(writeErr, "error writing WAL checkpoint")
+	}
+	if closeErr != nil {
+		return errors.Wrap(closeErr, "error closing WAL checkpoint file")
+	}
+	if err := os.Rename(snapshotPath, filepath.Join(w.dir, "checkpoint.mmdb")); err != nil {
+		return errors.Wrap(err, "error finalizing WAL checkpoint")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sealed := w.segment.Name()
+	if err := w.segment.Close(); err != nil {
+		return errors.Wrap(err, "error closing sealed WAL segment")
+	}
+	if err := w.openNewSegment(); err != nil {
+		return err
+	}
+
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		path := w.segmentPath(n)
+		if path == sealed || path == w.segment.Name() {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return errors.Wrapf(err, "error removing replayed WAL segment %s", path)
+		}
+	}
+	if err := os.Remove(sealed); err != nil {
+		return errors.Wrapf(err, "error removing sealed WAL segment %s", sealed)
+	}
+	return nil
+}
+
+// LoadWAL rebuilds a Tree from dir: the most recent checkpoint.mmdb
+// snapshot, if one exists, seeds the tree, and every segment in dir is
+// then replayed over it, in order. The WAL is attached to the returned
+// Tree so that further Insert* calls continue to be logged to it.
+//
+// Seeding from the checkpoint is required for correctness, not just an
+// optimization: maybeRotate deletes the segments it has folded into a
+// checkpoint, so a replay that started from an empty tree and ignored
+// the checkpoint would silently lose everything written before the most
+// recent rotation.
+func LoadWAL(dir string, opts Options) (*Tree, error) {
+	checkpointPath := filepath.Join(dir, "checkpoint.mmdb")
+
+	var t *Tree
+	switch _, statErr := os.Stat(checkpointPath); {
+	case statErr == nil:
+		loaded, err := Load(checkpointPath, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading WAL checkpoint")
+		}
+		t = loaded
+	case os.IsNotExist(statErr):
+		newTree, err := New(opts)
+		if err != nil {
+			return nil, err
+		}
+		t = newTree
+	default:
+		return nil, errors.Wrapf(statErr, "error checking for WAL checkpoint %s", checkpointPath)
+	}
+
+	if err := replayWAL(dir, func(kind mutationKind, payload []byte) error {
+		return applyWALEntry(t, kind, payload)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := t.EnableWAL(dir, WALOptions{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func applyWALEntry(t *Tree, kind mutationKind, payload []byte) error {
+	switch kind {
+	case mutationInsert:
+		network, value, sid, err := decodeInsertPayload(payload)
+		if err != nil {
+			return err
+		}
+		return t.InsertMergeWith(network, value, sid.strategy())
+	case mutationInsertReservedNetwork:
+		network, err := decodeNetworkPayload(payload)
+		if err != nil {
+			return err
+		}
+		return t.InsertReservedNetwork(network)
+	default:
+		return errors.Errorf("unknown WAL mutation kind %d", kind)
+	}
+}
+
+// replayWAL calls apply, in order, for every record found in dir's
+// segments. A segment is read up to and including its last complete
+// record; a partial record at the end (left by a crash mid-append) is
+// treated as the end of that segment rather than an error, while a
+// complete record whose checksum does not match stops the replay with
+// an error.
+func replayWAL(dir string, apply func(kind mutationKind, payload []byte) error) error {
+	segments, err := walSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range segments {
+		path := filepath.Join(dir, fmt.Sprintf("%06d.wal", n))
+		if err := replaySegment(path, apply); err != nil {
+			return errors.Wrapf(err, "error replaying WAL segment %s", path)
+		}
+	}
+	return nil
+}
+
+func replaySegment(path string, apply func(kind mutationKind, payload []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		kind, payload, n, err := readWALRecord(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "at offset %d", offset)
+		}
+		offset += n
+		if err := apply(kind, payload); err != nil {
+			return err
+		}
+	}
+}
+
+// maxWALRecordPayload bounds the payload length readWALRecord will ever
+// allocate for. It is far larger than any record this package writes
+// (see encodeInsertPayload, encodeNetworkPayload) and exists only to
+// reject a corrupt length field before it is trusted.
+const maxWALRecordPayload = 64 << 20 // 64 MiB
+
+// readWALRecord reads one record from r, returning its kind, payload,
+// and the total number of bytes consumed (header plus payload) so a
+// caller such as replaySegment can track and report its position in the
+// segment.
+func readWALRecord(r io.Reader) (mutationKind, []byte, int64, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	kind := mutationKind(header[4])
+	wantCRC := binary.BigEndian.Uint32(header[5:9])
+
+	// length is taken from the header before its CRC is checked, so a
+	// torn write that leaves a bogus length must not be trusted: a zero
+	// length underflows the make below to a ~4 GiB slice, and a large
+	// garbage length allocates arbitrarily. Either way, treat it the
+	// same as a partial record at the end of the log.
+	if length == 0 || length-1 > maxWALRecordPayload {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	crc := crc32.Update(0, crc32cTable, header[4:5])
+	crc = crc32.Update(crc, crc32cTable, payload)
+	if crc != wantCRC {
+		return 0, nil, 0, errors.New("WAL record has invalid checksum (corrupt or torn write)")
+	}
+	return kind, payload, int64(len(header) + len(payload)), nil
+}
+
+func encodeNetworkPayload(network *net.IPNet) ([]byte, error) {
+	prefixLen, bits := network.Mask.Size()
+	// The address width follows the mask, not the address: an
+	// IPv4-mapped IPv6 network has a 16-byte mask and must stay IPv6.
+	var ipVersion byte
+	var ip net.IP
+	switch bits {
+	case 32:
+		ipVersion, ip = 4, network.IP.To4()
+	case 128:
+		ipVersion, ip = 6, network.IP.To16()
+	}
+	if ip == nil {
+		return nil, errors.Errorf("invalid network %s", network)
+	}
+
+	buf := make([]byte, 2+len(ip))
+	buf[0] = ipVersion
+	buf[1] = byte(prefixLen)
+	copy(buf[2:], ip)
+	return buf, nil
+}
+
+func decodeNetworkPayload(payload []byte) (*net.IPNet, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("truncated WAL network payload")
+	}
+	ipVersion := payload[0]
+	prefixLen := int(payload[1])
+	ip := payload[2:]
+
+	var bits int
+	switch ipVersion {
+	case 4:
+		bits = 32
+	case 6:
+		bits = 128
+	default:
+		return nil, errors.Errorf("invalid IP version %d in WAL payload", ipVersion)
+	}
+	if len(ip)*8 != bits {
+		return nil, errors.New("truncated WAL network payload")
+	}
+
+	return &net.IPNet{
+		IP:   net.IP(ip),
+		Mask: net.CIDRMask(prefixLen, bits),
+	}, nil
+}
+
+func encodeInsertPayload(network *net.IPNet, value DataType, sid strategyID) ([]byte, error) {
+	networkPayload, err := encodeNetworkPayload(network)
+	if err != nil {
+		return nil, err
+	}
+
+	dw := newDataWriter(true)
+	if _, err := value.writeTo(dw); err != nil {
+		return nil, errors.Wrap(err, "error encoding WAL record value")
+	}
+
+	buf := make([]byte, 0, len(networkPayload)+1+dw.Len())
+	buf = append(buf, networkPayload...)
+	buf = append(buf, byte(sid))
+	buf = append(buf, dw.Bytes()...)
+	return buf, nil
+}
+
+func decodeInsertPayload(payload []byte) (*net.IPNet, DataType, strategyID, error) {
+	if len(payload) < 2 {
+		return nil, nil, 0, errors.New("truncated WAL insert payload")
+	}
+	ipVersion := payload[0]
+
+	var addrLen int
+	switch ipVersion {
+	case 4:
+		addrLen = 4
+	case 6:
+		addrLen = 16
+	default:
+		return nil, nil, 0, errors.Errorf("invalid IP version %d in WAL payload", ipVersion)
+	}
+	if len(payload) < 2+addrLen+1 {
+		return nil, nil, 0, errors.New("truncated WAL insert payload")
+	}
+
+	network, err := decodeNetworkPayload(payload[:2+addrLen])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sid := strategyID(payload[2+addrLen])
+	valueBytes := payload[2+addrLen+1:]
+
+	value, _, err := readDataType(valueBytes)
+	if err != nil {
+		return nil, nil, 0, errors.Wrap(err, "error decoding WAL record value")
+	}
+	return network, value, sid, nil
+}
+
+// WALInspect reads every record in the WAL segments under dir and writes
+// a human-readable line for each to out. It is a debugging aid and does
+// not modify dir.
+func WALInspect(dir string, out io.Writer) error {
+	i := 0
+	err := replayWAL(dir, func(kind mutationKind, payload []byte) error {
+		defer func() { i++ }()
+		switch kind {
+		case mutationInsert:
+			network, value, sid, err := decodeInsertPayload(payload)
+			if err != nil {
+				fmt.Fprintf(out, "%d: insert: error: %s\n", i, err)
+				return nil
+			}
+			fmt.Fprintf(out, "%d: insert %s strategy=%d value=%#v\n", i, network, sid, value)
+		case mutationInsertReservedNetwork:
+			network, err := decodeNetworkPayload(payload)
+			if err != nil {
+				fmt.Fprintf(out, "%d: insert-reserved: error: %s\n", i, err)
+				return nil
+			}
+			fmt.Fprintf(out, "%d: insert-reserved %s\n", i, network)
+		default:
+			fmt.Fprintf(out, "%d: unknown record kind %d\n", i, kind)
+		}
+		return nil
+	})
+	return err
+}